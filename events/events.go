@@ -0,0 +1,144 @@
+// Copyright (C) 2014 Jakob Borg and Contributors (see the CONTRIBUTORS file).
+// All rights reserved. Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file.
+
+// Package events provides a simple publish/subscribe event bus used to
+// notify the GUI and other third party integrations about model state
+// changes, without requiring them to poll.
+package events
+
+import (
+	"sync"
+	"time"
+)
+
+// EventType is a bitmask identifying one or more kinds of event. Masks are
+// combined with bitwise-or when subscribing, so that a subscriber only
+// receives the events it cares about.
+type EventType uint64
+
+const (
+	RepoStateChanged EventType = 1 << iota
+	RemoteIndexUpdated
+	LocalIndexUpdated
+	NodeConnected
+	NodeDisconnected
+	ItemStarted
+	ItemFinished
+	ConfigSaved
+
+	AllEvents = RepoStateChanged | RemoteIndexUpdated | LocalIndexUpdated |
+		NodeConnected | NodeDisconnected | ItemStarted | ItemFinished | ConfigSaved
+)
+
+func (t EventType) String() string {
+	switch t {
+	case RepoStateChanged:
+		return "RepoStateChanged"
+	case RemoteIndexUpdated:
+		return "RemoteIndexUpdated"
+	case LocalIndexUpdated:
+		return "LocalIndexUpdated"
+	case NodeConnected:
+		return "NodeConnected"
+	case NodeDisconnected:
+		return "NodeDisconnected"
+	case ItemStarted:
+		return "ItemStarted"
+	case ItemFinished:
+		return "ItemFinished"
+	case ConfigSaved:
+		return "ConfigSaved"
+	default:
+		return "Unknown"
+	}
+}
+
+// Event is a single occurrence on the bus. ID is a monotonically
+// increasing sequence number, unique and ordered across all events
+// regardless of subscriber, so that a client can detect whether it has
+// missed anything.
+type Event struct {
+	ID   int
+	Time time.Time
+	Type EventType
+	Data interface{}
+}
+
+// bufferSize is the number of unconsumed events a subscription will hold
+// before new events are dropped for that subscriber.
+const bufferSize = 64
+
+// Subscription receives events matching the mask it was created with.
+type Subscription struct {
+	mask EventType
+	C    chan Event
+}
+
+// Logger is an event bus. The zero value is not usable; use NewLogger.
+type Logger struct {
+	subs   []*Subscription
+	nextID int
+	mutex  sync.Mutex
+}
+
+// Default is a package level Logger for convenience, mirroring the package
+// level loggers used elsewhere in this codebase (e.g. logger.DefaultLogger).
+var Default = NewLogger()
+
+func NewLogger() *Logger {
+	return &Logger{}
+}
+
+// Log broadcasts an event of the given type to all matching subscribers.
+// A slow subscriber that hasn't drained its channel will miss the event
+// rather than block the sender.
+func (l *Logger) Log(t EventType, data interface{}) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	l.nextID++
+	e := Event{
+		ID:   l.nextID,
+		Time: time.Now(),
+		Type: t,
+		Data: data,
+	}
+
+	for _, s := range l.subs {
+		if s.mask&t == 0 {
+			continue
+		}
+		select {
+		case s.C <- e:
+		default:
+		}
+	}
+}
+
+// Subscribe returns a new Subscription receiving events whose type matches
+// any bit set in mask. The caller must call Unsubscribe when done.
+func (l *Logger) Subscribe(mask EventType) *Subscription {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	s := &Subscription{
+		mask: mask,
+		C:    make(chan Event, bufferSize),
+	}
+	l.subs = append(l.subs, s)
+	return s
+}
+
+// Unsubscribe removes a subscription so it no longer receives events.
+func (l *Logger) Unsubscribe(s *Subscription) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	for i, cur := range l.subs {
+		if cur == s {
+			l.subs = append(l.subs[:i], l.subs[i+1:]...)
+			break
+		}
+	}
+}
@@ -0,0 +1,97 @@
+// Copyright (C) 2014 Jakob Borg and Contributors (see the CONTRIBUTORS file).
+// All rights reserved. Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file.
+
+package events
+
+import (
+	"testing"
+	"time"
+)
+
+func TestSubscribeMaskFiltering(t *testing.T) {
+	l := NewLogger()
+	sub := l.Subscribe(NodeConnected | NodeDisconnected)
+	defer l.Unsubscribe(sub)
+
+	l.Log(RepoStateChanged, "should not be delivered")
+	l.Log(NodeConnected, "node1")
+
+	select {
+	case e := <-sub.C:
+		if e.Type != NodeConnected {
+			t.Fatalf("got event type %v, want NodeConnected", e.Type)
+		}
+		if e.Data.(string) != "node1" {
+			t.Fatalf("got data %v, want node1", e.Data)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("timed out waiting for event")
+	}
+
+	select {
+	case e := <-sub.C:
+		t.Fatalf("unexpected extra event delivered: %v", e)
+	default:
+	}
+}
+
+func TestUnsubscribeStopsDelivery(t *testing.T) {
+	l := NewLogger()
+	sub := l.Subscribe(AllEvents)
+	l.Unsubscribe(sub)
+
+	l.Log(NodeConnected, nil)
+
+	select {
+	case e := <-sub.C:
+		t.Fatalf("event delivered after unsubscribe: %v", e)
+	default:
+	}
+}
+
+func TestEventIDsAreMonotonicAcrossSubscribers(t *testing.T) {
+	l := NewLogger()
+	a := l.Subscribe(AllEvents)
+	b := l.Subscribe(AllEvents)
+	defer l.Unsubscribe(a)
+	defer l.Unsubscribe(b)
+
+	l.Log(NodeConnected, nil)
+	l.Log(NodeDisconnected, nil)
+
+	ea := <-a.C
+	eb := <-b.C
+	if ea.ID != eb.ID {
+		t.Fatalf("first event ID differs between subscribers: %d != %d", ea.ID, eb.ID)
+	}
+
+	ea2 := <-a.C
+	if ea2.ID <= ea.ID {
+		t.Fatalf("event IDs not increasing: %d then %d", ea.ID, ea2.ID)
+	}
+}
+
+func TestSlowSubscriberDropsRatherThanBlocks(t *testing.T) {
+	l := NewLogger()
+	sub := l.Subscribe(AllEvents)
+	defer l.Unsubscribe(sub)
+
+	for i := 0; i < bufferSize+10; i++ {
+		l.Log(NodeConnected, i)
+	}
+	// None of the above should have blocked; draining should yield at
+	// most bufferSize events.
+	n := 0
+	for {
+		select {
+		case <-sub.C:
+			n++
+		default:
+			if n > bufferSize {
+				t.Fatalf("got %d buffered events, want at most %d", n, bufferSize)
+			}
+			return
+		}
+	}
+}
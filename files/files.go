@@ -0,0 +1,382 @@
+// Copyright (C) 2014 Jakob Borg and Contributors (see the CONTRIBUTORS file).
+// All rights reserved. Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file.
+
+// Package files holds, per repository, the set of files known to exist on
+// the local node and on every connected peer. From that it derives the
+// global (cluster-wide newest) version of each file and what the local
+// node still needs to fetch to catch up with it. File/deleted counts and
+// byte totals for the global, local and per-node need views are maintained
+// incrementally as entries change, so that a caller such as
+// Model.ConnectionStats can read them in O(1) instead of walking the
+// entire file list on every call.
+package files
+
+import (
+	"sync"
+
+	"github.com/calmh/syncthing/lamport"
+	"github.com/calmh/syncthing/protocol"
+	"github.com/syndtr/goleveldb/leveldb"
+)
+
+// zeroEntrySize is the nominal size attributed to a directory or a deleted
+// file. Neither has block data of its own, but each must still count for
+// something or a repo consisting only of empty directories, or one that's
+// fully caught up on deletes, would always look 100% synced either way.
+const zeroEntrySize = 128
+
+// counts is an incrementally maintained files/deleted/bytes aggregate.
+type counts struct {
+	files   int
+	deleted int
+	bytes   int64
+}
+
+func sizeOf(f protocol.FileInfo) (files, deleted int, bytes int64) {
+	switch {
+	case protocol.IsDeleted(f.Flags):
+		return 0, 1, zeroEntrySize
+	case protocol.IsDirectory(f.Flags):
+		return 1, 0, zeroEntrySize
+	default:
+		return 1, 0, f.Size()
+	}
+}
+
+func (c *counts) add(f protocol.FileInfo) {
+	fs, de, by := sizeOf(f)
+	c.files += fs
+	c.deleted += de
+	c.bytes += by
+}
+
+func (c *counts) remove(f protocol.FileInfo) {
+	fs, de, by := sizeOf(f)
+	c.files -= fs
+	c.deleted -= de
+	c.bytes -= by
+}
+
+// Set holds the per-node file lists for a single repository, the global
+// view derived from them, and the size aggregates kept in step with both.
+type Set struct {
+	repo string
+	db   *leveldb.DB // kept for parity with the persistent index loader
+
+	mut sync.RWMutex
+
+	have map[protocol.NodeID]map[string]protocol.FileInfo // node -> name -> file
+	seq  map[protocol.NodeID]uint64                        // node -> change counter
+
+	global     map[string]protocol.FileInfo            // name -> highest-versioned file across all nodes
+	haveGlobal map[string]map[protocol.NodeID]bool      // name -> node -> does node's entry match global
+
+	globalCount counts
+	haveCount   map[protocol.NodeID]*counts
+	needCount   map[protocol.NodeID]*counts
+}
+
+// NewSet returns an empty Set for the given repository.
+func NewSet(repo string, db *leveldb.DB) *Set {
+	return &Set{
+		repo:       repo,
+		db:         db,
+		have:       make(map[protocol.NodeID]map[string]protocol.FileInfo),
+		seq:        make(map[protocol.NodeID]uint64),
+		global:     make(map[string]protocol.FileInfo),
+		haveGlobal: make(map[string]map[protocol.NodeID]bool),
+		haveCount:  make(map[protocol.NodeID]*counts),
+		needCount:  make(map[protocol.NodeID]*counts),
+	}
+}
+
+// Replace sets node's entire file list to fs, dropping whatever it
+// previously had for names that are no longer present.
+func (s *Set) Replace(node protocol.NodeID, fs []protocol.FileInfo) {
+	s.mut.Lock()
+	defer s.mut.Unlock()
+	s.replaceLocked(node, fs, false)
+}
+
+// ReplaceWithDelete behaves like Replace, except that a name node
+// previously had which is missing from fs is not dropped outright but
+// kept as an explicit, version-bumped delete. This is what a local rescan
+// needs: a file that disappeared between scans must still be advertised
+// as deleted so that peers that have it can catch up, instead of it
+// silently vanishing from the index.
+func (s *Set) ReplaceWithDelete(node protocol.NodeID, fs []protocol.FileInfo) {
+	s.mut.Lock()
+	defer s.mut.Unlock()
+	s.replaceLocked(node, fs, true)
+}
+
+func (s *Set) replaceLocked(node protocol.NodeID, fs []protocol.FileInfo, keepAsDeleted bool) {
+	existing := s.have[node]
+	seen := make(map[string]bool, len(fs))
+
+	for _, f := range fs {
+		seen[f.Name] = true
+		s.setLocked(node, f)
+	}
+
+	for name, old := range existing {
+		if seen[name] {
+			continue
+		}
+		if keepAsDeleted && !protocol.IsDeleted(old.Flags) {
+			tomb := old
+			tomb.Flags |= protocol.FlagDeleted
+			tomb.Blocks = nil
+			tomb.Version = lamport.Default.Tick(old.Version)
+			s.setLocked(node, tomb)
+		} else {
+			s.removeLocked(node, name)
+		}
+	}
+
+	s.seq[node]++
+}
+
+// Update applies incremental changes to node's file list; names not
+// mentioned in fs are left untouched.
+func (s *Set) Update(node protocol.NodeID, fs []protocol.FileInfo) {
+	s.mut.Lock()
+	defer s.mut.Unlock()
+	for _, f := range fs {
+		s.setLocked(node, f)
+	}
+	s.seq[node]++
+}
+
+func (s *Set) setLocked(node protocol.NodeID, f protocol.FileInfo) {
+	nodeFiles := s.have[node]
+	if nodeFiles == nil {
+		nodeFiles = make(map[string]protocol.FileInfo)
+		s.have[node] = nodeFiles
+		// A node seen for the first time needs every name already in the
+		// global view; recomputeLocked below only revisits f.Name.
+		nc := s.needCountLocked(node)
+		for name, g := range s.global {
+			s.haveGlobal[name][node] = false
+			nc.add(g)
+		}
+	}
+
+	hc := s.haveCountLocked(node)
+	if old, ok := nodeFiles[f.Name]; ok {
+		hc.remove(old)
+	}
+	nodeFiles[f.Name] = f
+	hc.add(f)
+
+	s.recomputeLocked(f.Name)
+}
+
+func (s *Set) removeLocked(node protocol.NodeID, name string) {
+	nodeFiles := s.have[node]
+	old, ok := nodeFiles[name]
+	if !ok {
+		return
+	}
+	delete(nodeFiles, name)
+	s.haveCountLocked(node).remove(old)
+	s.recomputeLocked(name)
+}
+
+func (s *Set) haveCountLocked(node protocol.NodeID) *counts {
+	c := s.haveCount[node]
+	if c == nil {
+		c = &counts{}
+		s.haveCount[node] = c
+	}
+	return c
+}
+
+func (s *Set) needCountLocked(node protocol.NodeID) *counts {
+	c := s.needCount[node]
+	if c == nil {
+		c = &counts{}
+		s.needCount[node] = c
+	}
+	return c
+}
+
+// recomputeLocked re-derives the global entry for name from the current
+// per-node state, and adjusts every node's need aggregate for whatever
+// changed. It only ever looks at the one name that was just touched, so a
+// single file change costs O(nodes), not O(files).
+func (s *Set) recomputeLocked(name string) {
+	var newGlobal protocol.FileInfo
+	haveNewGlobal := false
+	for _, nodeFiles := range s.have {
+		f, ok := nodeFiles[name]
+		if !ok {
+			continue
+		}
+		if !haveNewGlobal || f.Version > newGlobal.Version {
+			newGlobal = f
+			haveNewGlobal = true
+		}
+	}
+
+	oldGlobal, hadOldGlobal := s.global[name]
+	globalChanged := haveNewGlobal != hadOldGlobal ||
+		(haveNewGlobal && hadOldGlobal && newGlobal.Version != oldGlobal.Version)
+
+	if globalChanged {
+		if hadOldGlobal {
+			s.globalCount.remove(oldGlobal)
+		}
+		if haveNewGlobal {
+			s.globalCount.add(newGlobal)
+		}
+	}
+
+	matchSet := s.haveGlobal[name]
+
+	if !haveNewGlobal {
+		for node, was := range matchSet {
+			if was {
+				continue
+			}
+			s.needCountLocked(node).remove(oldGlobal)
+		}
+		delete(s.global, name)
+		delete(s.haveGlobal, name)
+		return
+	}
+
+	s.global[name] = newGlobal
+	if matchSet == nil {
+		matchSet = make(map[protocol.NodeID]bool)
+		s.haveGlobal[name] = matchSet
+	}
+
+	for node, nodeFiles := range s.have {
+		f, ok := nodeFiles[name]
+		matches := ok && f.Version == newGlobal.Version
+		was, tracked := matchSet[node]
+
+		if tracked && was == matches && !globalChanged {
+			continue
+		}
+
+		if tracked && !was {
+			s.needCountLocked(node).remove(oldGlobal)
+		}
+		if !matches {
+			s.needCountLocked(node).add(newGlobal)
+		}
+		matchSet[node] = matches
+	}
+}
+
+// Get returns node's own entry for name, the zero value if it has none.
+func (s *Set) Get(node protocol.NodeID, name string) protocol.FileInfo {
+	s.mut.RLock()
+	defer s.mut.RUnlock()
+	return s.have[node][name]
+}
+
+// GetGlobal returns the highest-versioned known entry for name across all
+// nodes, the zero value if name is unknown.
+func (s *Set) GetGlobal(name string) protocol.FileInfo {
+	s.mut.RLock()
+	defer s.mut.RUnlock()
+	return s.global[name]
+}
+
+// WithHave calls fn for every file node currently has, until fn returns
+// false.
+func (s *Set) WithHave(node protocol.NodeID, fn func(protocol.FileInfo) bool) {
+	s.mut.RLock()
+	fs := make([]protocol.FileInfo, 0, len(s.have[node]))
+	for _, f := range s.have[node] {
+		fs = append(fs, f)
+	}
+	s.mut.RUnlock()
+
+	for _, f := range fs {
+		if !fn(f) {
+			break
+		}
+	}
+}
+
+// WithNeed calls fn, with the global entry, for every name whose global
+// version node does not currently have, until fn returns false.
+func (s *Set) WithNeed(node protocol.NodeID, fn func(protocol.FileInfo) bool) {
+	s.mut.RLock()
+	var fs []protocol.FileInfo
+	for name, global := range s.global {
+		if !s.haveGlobal[name][node] {
+			fs = append(fs, global)
+		}
+	}
+	s.mut.RUnlock()
+
+	for _, f := range fs {
+		if !fn(f) {
+			break
+		}
+	}
+}
+
+// Changes returns a counter that increases every time Replace, Update or
+// ReplaceWithDelete changes node's file list, so that a caller can cheaply
+// notice when it needs to re-announce an index.
+func (s *Set) Changes(node protocol.NodeID) uint64 {
+	s.mut.RLock()
+	defer s.mut.RUnlock()
+	return s.seq[node]
+}
+
+// GlobalSize returns the number of files, deleted files and total bytes
+// across the global (cluster-wide newest) view of the repository.
+func (s *Set) GlobalSize() (files, deleted int, bytes int64) {
+	s.mut.RLock()
+	defer s.mut.RUnlock()
+	return s.globalCount.files, s.globalCount.deleted, s.globalCount.bytes
+}
+
+// GlobalBytes is GlobalSize's byte total on its own, for the completion
+// math in Model.ConnectionStats.
+func (s *Set) GlobalBytes() int64 {
+	s.mut.RLock()
+	defer s.mut.RUnlock()
+	return s.globalCount.bytes
+}
+
+// LocalSize returns the number of files, deleted files and total bytes
+// that protocol.LocalNodeID currently has.
+func (s *Set) LocalSize() (files, deleted int, bytes int64) {
+	s.mut.RLock()
+	defer s.mut.RUnlock()
+	if c, ok := s.haveCount[protocol.LocalNodeID]; ok {
+		return c.files, c.deleted, c.bytes
+	}
+	return 0, 0, 0
+}
+
+// NeedSize returns the number of files, deleted files and total bytes that
+// node would have to fetch to catch up with the global state.
+func (s *Set) NeedSize(node protocol.NodeID) (files, deleted int, bytes int64) {
+	s.mut.RLock()
+	defer s.mut.RUnlock()
+	if c, ok := s.needCount[node]; ok {
+		return c.files, c.deleted, c.bytes
+	}
+	return 0, 0, 0
+}
+
+// NeedBytes is NeedSize's byte total on its own, for the completion math
+// in Model.ConnectionStats.
+func (s *Set) NeedBytes(node protocol.NodeID) int64 {
+	s.mut.RLock()
+	defer s.mut.RUnlock()
+	if c, ok := s.needCount[node]; ok {
+		return c.bytes
+	}
+	return 0
+}
@@ -0,0 +1,208 @@
+// Copyright (C) 2014 Jakob Borg and Contributors (see the CONTRIBUTORS file).
+// All rights reserved. Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file.
+
+package files
+
+import (
+	"sync"
+	"testing"
+
+	"github.com/calmh/syncthing/protocol"
+)
+
+func node(b byte) protocol.NodeID {
+	var n protocol.NodeID
+	n[0] = b
+	return n
+}
+
+func file(name string, version uint64, size int64) protocol.FileInfo {
+	var blocks []protocol.BlockInfo
+	if size > 0 {
+		blocks = []protocol.BlockInfo{{Offset: 0, Size: int32(size)}}
+	}
+	return protocol.FileInfo{Name: name, Version: version, Blocks: blocks}
+}
+
+func TestGlobalAndLocalSizeAfterReplace(t *testing.T) {
+	s := NewSet("repo", nil)
+	n0 := node(9)
+
+	s.Replace(n0, []protocol.FileInfo{
+		file("a", 1, 100),
+		file("b", 1, 200),
+	})
+
+	files, deleted, bytes := s.GlobalSize()
+	if files != 2 || deleted != 0 || bytes != 300 {
+		t.Fatalf("GlobalSize() = %d, %d, %d, want 2, 0, 300", files, deleted, bytes)
+	}
+	files, deleted, bytes = s.LocalSize()
+	if files != 0 || deleted != 0 || bytes != 0 {
+		t.Fatalf("LocalSize() before any local replace = %d, %d, %d, want 0, 0, 0", files, deleted, bytes)
+	}
+
+	s.Replace(protocol.LocalNodeID, []protocol.FileInfo{file("a", 1, 100)})
+	files, deleted, bytes = s.LocalSize()
+	if files != 1 || deleted != 0 || bytes != 100 {
+		t.Fatalf("LocalSize() = %d, %d, %d, want 1, 0, 100", files, deleted, bytes)
+	}
+}
+
+func TestNeedSizeTracksRemoteAheadOfLocal(t *testing.T) {
+	s := NewSet("repo", nil)
+	remote := node(1)
+
+	s.Replace(protocol.LocalNodeID, []protocol.FileInfo{file("a", 1, 100)})
+	s.Replace(remote, []protocol.FileInfo{file("a", 2, 150)})
+
+	nf, nd, nb := s.NeedSize(protocol.LocalNodeID)
+	if nf != 1 || nd != 0 || nb != 150 {
+		t.Fatalf("NeedSize(local) = %d, %d, %d, want 1, 0, 150", nf, nd, nb)
+	}
+	if got := s.NeedBytes(protocol.LocalNodeID); got != 150 {
+		t.Fatalf("NeedBytes(local) = %d, want 150", got)
+	}
+	if got := s.GlobalBytes(); got != 150 {
+		t.Fatalf("GlobalBytes() = %d, want 150", got)
+	}
+
+	// Catch local up to the remote version; need should drop to zero.
+	s.Update(protocol.LocalNodeID, []protocol.FileInfo{file("a", 2, 150)})
+	nf, nd, nb = s.NeedSize(protocol.LocalNodeID)
+	if nf != 0 || nd != 0 || nb != 0 {
+		t.Fatalf("NeedSize(local) after catching up = %d, %d, %d, want 0, 0, 0", nf, nd, nb)
+	}
+}
+
+func TestReplaceWithDeleteTombstonesMissingFiles(t *testing.T) {
+	s := NewSet("repo", nil)
+	n0 := node(9)
+
+	s.Replace(n0, []protocol.FileInfo{file("a", 1, 100), file("b", 1, 100)})
+	s.ReplaceWithDelete(n0, []protocol.FileInfo{file("a", 1, 100)})
+
+	got := s.Get(n0, "b")
+	if !protocol.IsDeleted(got.Flags) {
+		t.Fatalf("Get(n0, %q).Flags = %#x, want FlagDeleted set", "b", got.Flags)
+	}
+	if got.Version <= 1 {
+		t.Fatalf("tombstone version = %d, want it bumped past the last known version", got.Version)
+	}
+
+	_, deleted, _ := s.GlobalSize()
+	if deleted != 1 {
+		t.Fatalf("GlobalSize() deleted = %d, want 1", deleted)
+	}
+}
+
+func TestReplacePlainDropsMissingFilesOutright(t *testing.T) {
+	s := NewSet("repo", nil)
+	n0 := node(9)
+
+	s.Replace(n0, []protocol.FileInfo{file("a", 1, 100), file("b", 1, 100)})
+	s.Replace(n0, []protocol.FileInfo{file("a", 1, 100)})
+
+	if got := s.Get(n0, "b"); got.Name != "" {
+		t.Fatalf("Get(n0, %q) = %+v, want the zero value after a plain Replace dropped it", "b", got)
+	}
+
+	files, deleted, _ := s.GlobalSize()
+	if files != 1 || deleted != 0 {
+		t.Fatalf("GlobalSize() = %d files, %d deleted, want 1, 0", files, deleted)
+	}
+}
+
+func TestConcurrentUpdatesKeepCountersConsistent(t *testing.T) {
+	s := NewSet("repo", nil)
+	nodes := []protocol.NodeID{protocol.LocalNodeID, node(1), node(2)}
+
+	var wg sync.WaitGroup
+	for i, n := range nodes {
+		n, version := n, uint64(i+1)
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 100; j++ {
+				s.Update(n, []protocol.FileInfo{file("shared", version, 100)})
+			}
+		}()
+	}
+	wg.Wait()
+
+	// Whichever node's version won, every size/need view must agree with
+	// what a brute-force walk of the current state would compute: exactly
+	// one global file, and zero need for nodes that match it.
+	files, deleted, bytes := s.GlobalSize()
+	if files != 1 || deleted != 0 || bytes != 100 {
+		t.Fatalf("GlobalSize() = %d, %d, %d, want 1, 0, 100", files, deleted, bytes)
+	}
+
+	global := s.GetGlobal("shared")
+	for _, n := range nodes {
+		have := s.Get(n, "shared")
+		nf, _, nb := s.NeedSize(n)
+		if have.Version == global.Version {
+			if nf != 0 || nb != 0 {
+				t.Fatalf("node %v has the global version but NeedSize = %d, %d, want 0, 0", n, nf, nb)
+			}
+		} else if nf != 1 || nb != global.Size() {
+			t.Fatalf("node %v lacks the global version but NeedSize = %d, %d, want 1, %d", n, nf, nb, global.Size())
+		}
+	}
+}
+
+// bruteForceGlobalBytes recomputes the global byte total by walking every
+// node's file list, the way ConnectionStats did before it was rewritten to
+// consume the incremental counters. It exists only so the benchmark below
+// can demonstrate the speedup, and is intentionally not how Set itself
+// computes GlobalBytes.
+func bruteForceGlobalBytes(s *Set) int64 {
+	s.mut.RLock()
+	defer s.mut.RUnlock()
+	best := make(map[string]protocol.FileInfo)
+	for _, nodeFiles := range s.have {
+		for name, f := range nodeFiles {
+			if cur, ok := best[name]; !ok || f.Version > cur.Version {
+				best[name] = f
+			}
+		}
+	}
+	var total int64
+	for _, f := range best {
+		_, _, b := sizeOf(f)
+		total += b
+	}
+	return total
+}
+
+func benchmarkSet(b *testing.B) *Set {
+	b.Helper()
+	s := NewSet("repo", nil)
+	nodes := []protocol.NodeID{node(0), node(1), node(2)}
+	for _, n := range nodes {
+		fs := make([]protocol.FileInfo, 1000)
+		for i := range fs {
+			fs[i] = file(string(rune('a'+i%26))+"/file", 1, 100)
+		}
+		s.Replace(n, fs)
+	}
+	return s
+}
+
+func BenchmarkGlobalBytesIncremental(b *testing.B) {
+	s := benchmarkSet(b)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		s.GlobalBytes()
+	}
+}
+
+func BenchmarkGlobalBytesBruteForce(b *testing.B) {
+	s := benchmarkSet(b)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		bruteForceGlobalBytes(s)
+	}
+}
@@ -0,0 +1,32 @@
+// Copyright (C) 2014 Jakob Borg and Contributors (see the CONTRIBUTORS file).
+// All rights reserved. Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file.
+
+package files
+
+import (
+	"sort"
+
+	"github.com/calmh/syncthing/protocol"
+)
+
+// SortBy ranks a FileInfo for ordering a need list, higher first; it is
+// the type of a repository's configured FileRanker, e.g. to pull small
+// files before large ones.
+type SortBy func(protocol.FileInfo) int
+
+// Sort orders fs by descending rank, highest priority first.
+func (r SortBy) Sort(fs []protocol.FileInfo) {
+	sort.Sort(&rankSorter{fs: fs, rank: r})
+}
+
+type rankSorter struct {
+	fs   []protocol.FileInfo
+	rank SortBy
+}
+
+func (s *rankSorter) Len() int      { return len(s.fs) }
+func (s *rankSorter) Swap(i, j int) { s.fs[i], s.fs[j] = s.fs[j], s.fs[i] }
+func (s *rankSorter) Less(i, j int) bool {
+	return s.rank(s.fs[i]) > s.rank(s.fs[j])
+}
@@ -0,0 +1,290 @@
+// Copyright (C) 2014 Jakob Borg and Contributors (see the CONTRIBUTORS file).
+// All rights reserved. Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file.
+
+// Package ignore implements a gitignore-compatible file matcher, used by
+// the scanner to decide which files and directories to skip and by the
+// GUI to show the effective rule set for a repository.
+package ignore
+
+import (
+	"bufio"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+)
+
+const ignoreFileName = ".stignore"
+
+// pattern is a single compiled ignore rule, anchored at the directory it
+// was loaded from.
+type pattern struct {
+	match   *regexp.Regexp
+	include bool // true if this is a negation ("!pattern")
+	dirOnly bool // true if this only applies to directories ("pattern/")
+	line    string
+}
+
+type dirRules struct {
+	patterns []pattern
+	modTime  time.Time
+	loaded   bool
+}
+
+// Matcher answers whether a given path in a repository is ignored. It loads
+// ".stignore" files from the root of the repository and lazily from every
+// directory encountered during a walk, reloading a directory's rules
+// whenever its ignore file's modification time changes.
+type Matcher struct {
+	root string
+
+	mut  sync.Mutex
+	dirs map[string]dirRules // relative dir ("" for root) -> rules
+}
+
+// New returns a Matcher rooted at the given repository directory.
+func New(root string) *Matcher {
+	return &Matcher{
+		root: root,
+		dirs: make(map[string]dirRules),
+	}
+}
+
+// Match reports whether relpath (slash separated, relative to the
+// repository root) is ignored, and whether it was explicitly included, i.e.
+// the last pattern matching it (root rules first, then each nested
+// directory's in turn) is a negation.
+// Directory-only patterns ("foo/") are honored by statting relpath under
+// the repository root; a relpath that no longer exists (e.g. it was just
+// deleted) is treated as a plain file for this purpose.
+func (m *Matcher) Match(relpath string) (ignored, included bool) {
+	relpath = filepath.ToSlash(relpath)
+	dir := relDirOf(relpath)
+
+	isDir := false
+	if fi, err := os.Lstat(filepath.Join(m.root, relpath)); err == nil {
+		isDir = fi.IsDir()
+	}
+
+	var matched *pattern
+	for _, rules := range m.rulesFromRootTo(dir) {
+		for i := range rules {
+			p := &rules[i]
+			if p.dirOnly && !isDir {
+				continue
+			}
+			if p.match.MatchString(relpath) {
+				matched = p
+			}
+		}
+	}
+
+	if matched == nil {
+		return false, false
+	}
+	return !matched.include, matched.include
+}
+
+// Patterns returns the raw lines of the repository's root ignore file, for
+// display in the GUI. It does not include nested per-directory rules.
+func (m *Matcher) Patterns() []string {
+	rules := m.rulesFor("")
+	lines := make([]string, len(rules))
+	for i, p := range rules {
+		lines[i] = p.line
+	}
+	return lines
+}
+
+// rulesFromRootTo returns the pattern sets for every directory from the
+// repository root down to (and including) dir, in that order, reloading
+// any that have changed on disk.
+func (m *Matcher) rulesFromRootTo(dir string) [][]pattern {
+	var sets [][]pattern
+	sets = append(sets, m.rulesFor(""))
+
+	if dir != "" && dir != "." {
+		var cur string
+		for _, part := range strings.Split(dir, "/") {
+			if part == "" {
+				continue
+			}
+			if cur == "" {
+				cur = part
+			} else {
+				cur = cur + "/" + part
+			}
+			sets = append(sets, m.rulesFor(cur))
+		}
+	}
+
+	return sets
+}
+
+func (m *Matcher) rulesFor(reldir string) []pattern {
+	fname := filepath.Join(m.root, reldir, ignoreFileName)
+
+	fi, err := os.Stat(fname)
+	if err != nil {
+		m.mut.Lock()
+		delete(m.dirs, reldir)
+		m.mut.Unlock()
+		return nil
+	}
+
+	m.mut.Lock()
+	defer m.mut.Unlock()
+
+	if cur, ok := m.dirs[reldir]; ok && cur.loaded && cur.modTime.Equal(fi.ModTime()) {
+		return cur.patterns
+	}
+
+	patterns := loadPatterns(fname, reldir)
+	m.dirs[reldir] = dirRules{patterns: patterns, modTime: fi.ModTime(), loaded: true}
+	return patterns
+}
+
+func loadPatterns(fname, reldir string) []pattern {
+	fd, err := os.Open(fname)
+	if err != nil {
+		return nil
+	}
+	defer fd.Close()
+
+	var patterns []pattern
+	scanner := bufio.NewScanner(fd)
+	for scanner.Scan() {
+		line := strings.TrimRight(scanner.Text(), "\r\n")
+		if p, ok := compilePattern(line, reldir); ok {
+			patterns = append(patterns, p)
+		}
+	}
+	return patterns
+}
+
+// compilePattern translates a single gitignore-style line, relative to the
+// directory it was loaded from (reldir), into a pattern.
+func compilePattern(line, reldir string) (pattern, bool) {
+	orig := line
+	if len(line) == 0 || strings.HasPrefix(line, "#") {
+		return pattern{}, false
+	}
+
+	include := false
+	if strings.HasPrefix(line, "!") {
+		include = true
+		line = line[1:]
+	}
+
+	dirOnly := false
+	if strings.HasSuffix(line, "/") {
+		dirOnly = true
+		line = strings.TrimSuffix(line, "/")
+	}
+
+	// gitignore anchors any pattern containing a slash other than a
+	// trailing one (added by the dirOnly check above) to the directory
+	// the pattern was loaded from; only a pattern with no interior slash
+	// is free to match at any depth below that directory.
+	anchored := strings.Contains(line, "/")
+	line = strings.TrimPrefix(line, "/")
+
+	expr := globToRegexp(line)
+	if anchored {
+		if reldir != "" {
+			expr = regexp.QuoteMeta(reldir+"/") + expr
+		}
+		expr = "^" + expr + "$"
+	} else if reldir == "" {
+		expr = "^(.*/)?" + expr + "$"
+	} else {
+		expr = "^" + regexp.QuoteMeta(reldir+"/") + "(.*/)?" + expr + "$"
+	}
+
+	re, err := regexp.Compile(expr)
+	if err != nil {
+		return pattern{}, false
+	}
+
+	return pattern{match: re, include: include, dirOnly: dirOnly, line: orig}, true
+}
+
+// globToRegexp converts a single gitignore glob segment (using "*", "?" and
+// "[...]") into the equivalent regular expression fragment. "*" does not
+// cross a path separator; "**" matches any number of directories; a
+// bracket expression is carried over verbatim as a regex character class,
+// with gitignore's "!" negation translated to regex's "^".
+func globToRegexp(glob string) string {
+	var b strings.Builder
+	for i := 0; i < len(glob); i++ {
+		switch c := glob[i]; c {
+		case '*':
+			if i+1 < len(glob) && glob[i+1] == '*' {
+				b.WriteString(".*")
+				i++
+			} else {
+				b.WriteString("[^/]*")
+			}
+		case '?':
+			b.WriteString("[^/]")
+		case '[':
+			end, neg, body := scanBracketExpr(glob[i+1:])
+			if end < 0 {
+				// No closing "]" found; "[" has no special meaning on its own.
+				b.WriteString("\\[")
+				continue
+			}
+			b.WriteByte('[')
+			if neg {
+				b.WriteByte('^')
+			}
+			b.WriteString(body)
+			b.WriteByte(']')
+			i += end + 1
+		case '.', '+', '(', ')', '|', '^', '$':
+			b.WriteByte('\\')
+			b.WriteByte(c)
+		default:
+			b.WriteByte(c)
+		}
+	}
+	return b.String()
+}
+
+// scanBracketExpr parses a gitignore bracket expression from s, which
+// starts right after the opening "[". It returns the index of the
+// closing "]" within s, whether the class is negated ("!" or "^" right
+// after the opening bracket), and the regex-safe class body between them.
+// end is -1 if s contains no closing "]", in which case neg and body are
+// meaningless and the caller should treat the "[" as a literal character.
+func scanBracketExpr(s string) (end int, neg bool, body string) {
+	i := 0
+	if i < len(s) && (s[i] == '!' || s[i] == '^') {
+		neg = true
+		i++
+	}
+	start := i
+	// A "]" right after the opening bracket (or negation) is a literal
+	// member of the class, not its terminator.
+	if i < len(s) && s[i] == ']' {
+		i++
+	}
+	for i < len(s) && s[i] != ']' {
+		i++
+	}
+	if i >= len(s) {
+		return -1, false, ""
+	}
+	return i, neg, strings.ReplaceAll(s[start:i], `\`, `\\`)
+}
+
+func relDirOf(relpath string) string {
+	dir := filepath.ToSlash(filepath.Dir(relpath))
+	if dir == "." {
+		return ""
+	}
+	return dir
+}
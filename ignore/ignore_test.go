@@ -0,0 +1,169 @@
+// Copyright (C) 2014 Jakob Borg and Contributors (see the CONTRIBUTORS file).
+// All rights reserved. Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file.
+
+package ignore
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func writeFile(t *testing.T, path, content string) {
+	t.Helper()
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(path, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestMatchAnchoredAtRoot(t *testing.T) {
+	root, err := ioutil.TempDir("", "ignore-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+
+	writeFile(t, filepath.Join(root, ".stignore"), "/foo\n")
+	writeFile(t, filepath.Join(root, "foo"), "")
+	writeFile(t, filepath.Join(root, "sub", "foo"), "")
+
+	m := New(root)
+	if ignored, _ := m.Match("foo"); !ignored {
+		t.Error("expected foo to be ignored")
+	}
+	if ignored, _ := m.Match("sub/foo"); ignored {
+		t.Error("expected sub/foo to not be ignored by an anchored root pattern")
+	}
+}
+
+func TestMatchInteriorSlashIsAnchored(t *testing.T) {
+	root, err := ioutil.TempDir("", "ignore-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+
+	writeFile(t, filepath.Join(root, ".stignore"), "a/b\n")
+	writeFile(t, filepath.Join(root, "a", "b"), "")
+	writeFile(t, filepath.Join(root, "x", "a", "b"), "")
+
+	m := New(root)
+	if ignored, _ := m.Match("a/b"); !ignored {
+		t.Error("expected a/b to be ignored")
+	}
+	if ignored, _ := m.Match("x/a/b"); ignored {
+		t.Error("a pattern with an interior slash must not match at arbitrary depth")
+	}
+}
+
+func TestMatchUnanchoredMatchesAnyDepth(t *testing.T) {
+	root, err := ioutil.TempDir("", "ignore-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+
+	writeFile(t, filepath.Join(root, ".stignore"), "*.o\n")
+	writeFile(t, filepath.Join(root, "a.o"), "")
+	writeFile(t, filepath.Join(root, "sub", "b.o"), "")
+
+	m := New(root)
+	if ignored, _ := m.Match("a.o"); !ignored {
+		t.Error("expected a.o to be ignored")
+	}
+	if ignored, _ := m.Match("sub/b.o"); !ignored {
+		t.Error("expected sub/b.o to be ignored, since the pattern has no interior slash")
+	}
+}
+
+func TestMatchNegationIncludes(t *testing.T) {
+	root, err := ioutil.TempDir("", "ignore-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+
+	writeFile(t, filepath.Join(root, ".stignore"), "*.o\n!keep.o\n")
+	writeFile(t, filepath.Join(root, "a.o"), "")
+	writeFile(t, filepath.Join(root, "keep.o"), "")
+
+	m := New(root)
+	if ignored, included := m.Match("a.o"); !ignored || included {
+		t.Errorf("a.o: got ignored=%v included=%v, want true/false", ignored, included)
+	}
+	if ignored, included := m.Match("keep.o"); ignored || !included {
+		t.Errorf("keep.o: got ignored=%v included=%v, want false/true", ignored, included)
+	}
+}
+
+func TestMatchDirOnly(t *testing.T) {
+	root, err := ioutil.TempDir("", "ignore-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+
+	writeFile(t, filepath.Join(root, ".stignore"), "build/\n")
+	if err := os.MkdirAll(filepath.Join(root, "build"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	writeFile(t, filepath.Join(root, "build.txt"), "")
+
+	m := New(root)
+	if ignored, _ := m.Match("build"); !ignored {
+		t.Error("expected the build directory to be ignored")
+	}
+	if ignored, _ := m.Match("build.txt"); ignored {
+		t.Error("a dir-only pattern must not match a same-named file")
+	}
+}
+
+func TestMatchNestedIgnoreFile(t *testing.T) {
+	root, err := ioutil.TempDir("", "ignore-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+
+	writeFile(t, filepath.Join(root, "sub", ".stignore"), "*.tmp\n")
+	writeFile(t, filepath.Join(root, "sub", "a.tmp"), "")
+	writeFile(t, filepath.Join(root, "a.tmp"), "")
+
+	m := New(root)
+	if ignored, _ := m.Match("sub/a.tmp"); !ignored {
+		t.Error("expected sub/a.tmp to be ignored by sub/.stignore")
+	}
+	if ignored, _ := m.Match("a.tmp"); ignored {
+		t.Error("a nested .stignore must not affect files outside its own directory")
+	}
+}
+
+func TestMatchBracketExpression(t *testing.T) {
+	root, err := ioutil.TempDir("", "ignore-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+
+	writeFile(t, filepath.Join(root, ".stignore"), "file[0-2].txt\n!file[!0-2].txt\n")
+	for _, name := range []string{"file0.txt", "file1.txt", "file2.txt", "file3.txt", "file9.txt"} {
+		writeFile(t, filepath.Join(root, name), "")
+	}
+
+	m := New(root)
+	for _, name := range []string{"file0.txt", "file1.txt", "file2.txt"} {
+		if ignored, _ := m.Match(name); !ignored {
+			t.Errorf("expected %s to match the [0-2] class and be ignored", name)
+		}
+	}
+	for _, name := range []string{"file3.txt", "file9.txt"} {
+		if ignored, _ := m.Match(name); ignored {
+			t.Errorf("expected %s to match the negated [!0-2] class and be included", name)
+		}
+	}
+}
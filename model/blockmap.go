@@ -0,0 +1,186 @@
+// Copyright (C) 2014 Jakob Borg and Contributors (see the CONTRIBUTORS file).
+// All rights reserved. Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file.
+
+package model
+
+import (
+	"bytes"
+	"encoding/binary"
+	"sync"
+
+	"github.com/calmh/syncthing/protocol"
+	"github.com/syndtr/goleveldb/leveldb"
+)
+
+// blockMapKeyPrefix is prepended to the block hash to form the leveldb key
+// under which the set of known locations for that hash is stored.
+var blockMapKeyPrefix = []byte("bm:")
+
+// blockLocation is a single known occurrence of a block, identified by the
+// repo and file it belongs to and its offset and length within that file.
+// The length is kept alongside the offset so that a short final block can
+// still be read back and verified correctly.
+type blockLocation struct {
+	repo   string
+	name   string
+	offset int64
+	size   int32
+}
+
+// blockMap is a global index from block hash to the set of repo/file/offset
+// locations where that hash is currently known to occur. It allows the
+// puller to find a local copy of a block it needs, instead of always
+// fetching it from a remote node. The index is persisted in the same
+// leveldb database as the rest of the model's state, so it survives
+// restarts and is shared between all repos.
+type blockMap struct {
+	db  *leveldb.DB
+	mut sync.Mutex
+}
+
+func newBlockMap(db *leveldb.DB) *blockMap {
+	return &blockMap{db: db}
+}
+
+// Add records the blocks of (repo, name) in the index.
+func (m *blockMap) Add(repo, name string, blocks []protocol.BlockInfo) error {
+	if len(blocks) == 0 {
+		return nil
+	}
+
+	m.mut.Lock()
+	defer m.mut.Unlock()
+
+	batch := new(leveldb.Batch)
+	for _, block := range blocks {
+		key := blockMapKey(block.Hash)
+		locs, err := m.getLocked(key)
+		if err != nil {
+			return err
+		}
+
+		loc := blockLocation{repo: repo, name: name, offset: block.Offset, size: block.Size}
+		if !containsLocation(locs, loc) {
+			locs = append(locs, loc)
+		}
+		batch.Put(key, marshalLocations(locs))
+	}
+	return m.db.Write(batch, nil)
+}
+
+// containsLocation reports whether locs already has an entry for the same
+// repo, file and offset as loc, so that repeated Add calls for an unchanged
+// file (e.g. across successive rescans) don't grow the index unboundedly.
+func containsLocation(locs []blockLocation, loc blockLocation) bool {
+	for _, l := range locs {
+		if l.repo == loc.repo && l.name == loc.name && l.offset == loc.offset {
+			return true
+		}
+	}
+	return false
+}
+
+// Discard removes the blocks of (repo, name) from the index. It is called
+// when a file is deleted or overwritten with a new version, so that stale
+// locations are not handed out to callers of Fetch.
+func (m *blockMap) Discard(repo, name string, blocks []protocol.BlockInfo) error {
+	if len(blocks) == 0 {
+		return nil
+	}
+
+	m.mut.Lock()
+	defer m.mut.Unlock()
+
+	batch := new(leveldb.Batch)
+	for _, block := range blocks {
+		key := blockMapKey(block.Hash)
+		locs, err := m.getLocked(key)
+		if err != nil {
+			return err
+		}
+
+		kept := locs[:0]
+		for _, loc := range locs {
+			if loc.repo != repo || loc.name != name {
+				kept = append(kept, loc)
+			}
+		}
+
+		if len(kept) == 0 {
+			batch.Delete(key)
+		} else {
+			batch.Put(key, marshalLocations(kept))
+		}
+	}
+	return m.db.Write(batch, nil)
+}
+
+// Fetch returns the known locations for the given block hash.
+func (m *blockMap) Fetch(hash []byte) ([]blockLocation, error) {
+	m.mut.Lock()
+	defer m.mut.Unlock()
+	return m.getLocked(blockMapKey(hash))
+}
+
+func (m *blockMap) getLocked(key []byte) ([]blockLocation, error) {
+	data, err := m.db.Get(key, nil)
+	if err == leveldb.ErrNotFound {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	return unmarshalLocations(data), nil
+}
+
+func blockMapKey(hash []byte) []byte {
+	key := make([]byte, 0, len(blockMapKeyPrefix)+len(hash))
+	key = append(key, blockMapKeyPrefix...)
+	key = append(key, hash...)
+	return key
+}
+
+func marshalLocations(locs []blockLocation) []byte {
+	var buf bytes.Buffer
+	for _, loc := range locs {
+		binary.Write(&buf, binary.BigEndian, uint16(len(loc.repo)))
+		buf.WriteString(loc.repo)
+		binary.Write(&buf, binary.BigEndian, uint16(len(loc.name)))
+		buf.WriteString(loc.name)
+		binary.Write(&buf, binary.BigEndian, loc.offset)
+		binary.Write(&buf, binary.BigEndian, loc.size)
+	}
+	return buf.Bytes()
+}
+
+func unmarshalLocations(data []byte) []blockLocation {
+	var locs []blockLocation
+	buf := bytes.NewReader(data)
+	for buf.Len() > 0 {
+		var l uint16
+		if binary.Read(buf, binary.BigEndian, &l) != nil {
+			break
+		}
+		repo := make([]byte, l)
+		buf.Read(repo)
+
+		if binary.Read(buf, binary.BigEndian, &l) != nil {
+			break
+		}
+		name := make([]byte, l)
+		buf.Read(name)
+
+		var offset int64
+		if binary.Read(buf, binary.BigEndian, &offset) != nil {
+			break
+		}
+
+		var size int32
+		if binary.Read(buf, binary.BigEndian, &size) != nil {
+			break
+		}
+
+		locs = append(locs, blockLocation{repo: string(repo), name: string(name), offset: offset, size: size})
+	}
+	return locs
+}
@@ -0,0 +1,132 @@
+// Copyright (C) 2014 Jakob Borg and Contributors (see the CONTRIBUTORS file).
+// All rights reserved. Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file.
+
+package model
+
+import (
+	"testing"
+
+	"github.com/calmh/syncthing/protocol"
+	"github.com/syndtr/goleveldb/leveldb"
+	"github.com/syndtr/goleveldb/leveldb/storage"
+)
+
+func newTestBlockMap(t *testing.T) *blockMap {
+	t.Helper()
+	db, err := leveldb.Open(storage.NewMemStorage(), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return newBlockMap(db)
+}
+
+var hashA = []byte("aaaaaaaaaaaaaaaaaaaa")
+var hashB = []byte("bbbbbbbbbbbbbbbbbbbb")
+
+func TestBlockMapAddFetch(t *testing.T) {
+	bm := newTestBlockMap(t)
+
+	blocks := []protocol.BlockInfo{{Offset: 0, Size: 128, Hash: hashA}}
+	if err := bm.Add("repo", "file.txt", blocks); err != nil {
+		t.Fatal(err)
+	}
+
+	locs, err := bm.Fetch(hashA)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(locs) != 1 || locs[0].repo != "repo" || locs[0].name != "file.txt" || locs[0].size != 128 {
+		t.Fatalf("got %+v, want one location for repo/file.txt size 128", locs)
+	}
+}
+
+func TestBlockMapAddIsIdempotentAcrossRescans(t *testing.T) {
+	bm := newTestBlockMap(t)
+
+	blocks := []protocol.BlockInfo{{Offset: 0, Size: 128, Hash: hashA}}
+	for i := 0; i < 3; i++ {
+		// Simulate repeated rescans of an unchanged file.
+		if err := bm.Add("repo", "file.txt", blocks); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	locs, err := bm.Fetch(hashA)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(locs) != 1 {
+		t.Fatalf("got %d locations after repeated Add, want 1 (index must not grow unboundedly)", len(locs))
+	}
+}
+
+func TestBlockMapRename(t *testing.T) {
+	bm := newTestBlockMap(t)
+
+	blocks := []protocol.BlockInfo{{Offset: 0, Size: 128, Hash: hashA}}
+	if err := bm.Add("repo", "old.txt", blocks); err != nil {
+		t.Fatal(err)
+	}
+	if err := bm.Discard("repo", "old.txt", blocks); err != nil {
+		t.Fatal(err)
+	}
+	if err := bm.Add("repo", "new.txt", blocks); err != nil {
+		t.Fatal(err)
+	}
+
+	locs, err := bm.Fetch(hashA)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(locs) != 1 || locs[0].name != "new.txt" {
+		t.Fatalf("got %+v, want a single location at new.txt", locs)
+	}
+}
+
+func TestBlockMapIdenticalBlocksAcrossFiles(t *testing.T) {
+	bm := newTestBlockMap(t)
+
+	blocks := []protocol.BlockInfo{{Offset: 0, Size: 128, Hash: hashA}}
+	if err := bm.Add("repo", "a.txt", blocks); err != nil {
+		t.Fatal(err)
+	}
+	if err := bm.Add("repo", "b.txt", blocks); err != nil {
+		t.Fatal(err)
+	}
+
+	locs, err := bm.Fetch(hashA)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(locs) != 2 {
+		t.Fatalf("got %d locations, want 2 (one per file sharing the block)", len(locs))
+	}
+}
+
+func TestBlockMapDiscardLeavesOtherHashesAlone(t *testing.T) {
+	bm := newTestBlockMap(t)
+
+	if err := bm.Add("repo", "file.txt", []protocol.BlockInfo{
+		{Offset: 0, Size: 128, Hash: hashA},
+		{Offset: 128, Size: 64, Hash: hashB},
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := bm.Discard("repo", "file.txt", []protocol.BlockInfo{{Offset: 0, Size: 128, Hash: hashA}}); err != nil {
+		t.Fatal(err)
+	}
+
+	if locs, err := bm.Fetch(hashA); err != nil {
+		t.Fatal(err)
+	} else if len(locs) != 0 {
+		t.Fatalf("got %d locations for a discarded hash, want 0", len(locs))
+	}
+
+	if locs, err := bm.Fetch(hashB); err != nil {
+		t.Fatal(err)
+	} else if len(locs) != 1 {
+		t.Fatalf("got %d locations for the untouched hash, want 1", len(locs))
+	}
+}
@@ -5,6 +5,7 @@
 package model
 
 import (
+	"bytes"
 	"compress/gzip"
 	"crypto/sha1"
 	"errors"
@@ -18,11 +19,14 @@ import (
 	"time"
 
 	"github.com/calmh/syncthing/config"
+	"github.com/calmh/syncthing/events"
 	"github.com/calmh/syncthing/files"
+	"github.com/calmh/syncthing/ignore"
 	"github.com/calmh/syncthing/lamport"
 	"github.com/calmh/syncthing/osutil"
 	"github.com/calmh/syncthing/protocol"
 	"github.com/calmh/syncthing/scanner"
+	"github.com/calmh/syncthing/versioner"
 	"github.com/syndtr/goleveldb/leveldb"
 )
 
@@ -35,11 +39,20 @@ const (
 	RepoCleaning
 )
 
-// Somewhat arbitrary amount of bytes that we choose to let represent the size
-// of an unsynchronized directory entry or a deleted file. We need it to be
-// larger than zero so that it's visible that there is some amount of bytes to
-// transfer to bring the systems into synchronization.
-const zeroEntrySize = 128
+func (s repoState) String() string {
+	switch s {
+	case RepoIdle:
+		return "idle"
+	case RepoScanning:
+		return "scanning"
+	case RepoCleaning:
+		return "cleaning"
+	case RepoSyncing:
+		return "syncing"
+	default:
+		return "unknown"
+	}
+}
 
 type Model struct {
 	indexDir string
@@ -49,12 +62,14 @@ type Model struct {
 	clientName    string
 	clientVersion string
 
-	repoCfgs   map[string]config.RepositoryConfiguration // repo -> cfg
-	repoFiles  map[string]*files.Set                     // repo -> files
-	repoNodes  map[string][]protocol.NodeID              // repo -> nodeIDs
-	nodeRepos  map[protocol.NodeID][]string              // nodeID -> repos
-	suppressor map[string]*suppressor                    // repo -> suppressor
-	rmut       sync.RWMutex                              // protects the above
+	repoCfgs       map[string]config.RepositoryConfiguration // repo -> cfg
+	repoFiles      map[string]*files.Set                     // repo -> files
+	repoNodes      map[string][]protocol.NodeID              // repo -> nodeIDs
+	nodeRepos      map[protocol.NodeID][]string              // nodeID -> repos
+	suppressor     map[string]*suppressor                    // repo -> suppressor
+	repoIgnores    map[string]*ignore.Matcher                // repo -> ignore matcher
+	repoVersioners map[string]versioner.Versioner            // repo -> versioner, nil if unversioned
+	rmut           sync.RWMutex                              // protects the above
 
 	repoState map[string]repoState // repo -> state
 	smut      sync.RWMutex
@@ -64,6 +79,8 @@ type Model struct {
 	nodeVer   map[protocol.NodeID]string
 	pmut      sync.RWMutex // protects protoConn and rawConn
 
+	blockFinder *blockMap
+
 	sup suppressor
 
 	addedRepo bool
@@ -80,21 +97,24 @@ var (
 // for file data without altering the local repository in any way.
 func NewModel(indexDir string, cfg *config.Configuration, clientName, clientVersion string, db *leveldb.DB) *Model {
 	m := &Model{
-		indexDir:      indexDir,
-		cfg:           cfg,
-		db:            db,
-		clientName:    clientName,
-		clientVersion: clientVersion,
-		repoCfgs:      make(map[string]config.RepositoryConfiguration),
-		repoFiles:     make(map[string]*files.Set),
-		repoNodes:     make(map[string][]protocol.NodeID),
-		nodeRepos:     make(map[protocol.NodeID][]string),
-		repoState:     make(map[string]repoState),
-		suppressor:    make(map[string]*suppressor),
-		protoConn:     make(map[protocol.NodeID]protocol.Connection),
-		rawConn:       make(map[protocol.NodeID]io.Closer),
-		nodeVer:       make(map[protocol.NodeID]string),
-		sup:           suppressor{threshold: int64(cfg.Options.MaxChangeKbps)},
+		indexDir:       indexDir,
+		cfg:            cfg,
+		db:             db,
+		clientName:     clientName,
+		clientVersion:  clientVersion,
+		repoCfgs:       make(map[string]config.RepositoryConfiguration),
+		repoFiles:      make(map[string]*files.Set),
+		repoNodes:      make(map[string][]protocol.NodeID),
+		nodeRepos:      make(map[protocol.NodeID][]string),
+		repoState:      make(map[string]repoState),
+		suppressor:     make(map[string]*suppressor),
+		repoIgnores:    make(map[string]*ignore.Matcher),
+		repoVersioners: make(map[string]versioner.Versioner),
+		protoConn:      make(map[protocol.NodeID]protocol.Connection),
+		rawConn:        make(map[protocol.NodeID]io.Closer),
+		nodeVer:        make(map[protocol.NodeID]string),
+		blockFinder:    newBlockMap(db),
+		sup:            suppressor{threshold: int64(cfg.Options.MaxChangeKbps)},
 	}
 
 	var timeout = 20 * 60 // seconds
@@ -108,6 +128,7 @@ func NewModel(indexDir string, cfg *config.Configuration, clientName, clientVers
 	deadlockDetect(&m.smut, time.Duration(timeout)*time.Second)
 	deadlockDetect(&m.pmut, time.Duration(timeout)*time.Second)
 	go m.broadcastIndexLoop()
+	go m.versionerCleanLoop()
 	return m
 }
 
@@ -162,32 +183,10 @@ func (m *Model) ConnectionStats() map[string]ConnectionInfo {
 		var have int64
 
 		for _, repo := range m.nodeRepos[node] {
-			m.repoFiles[repo].WithGlobal(func(f protocol.FileInfo) bool {
-				if !protocol.IsDeleted(f.Flags) {
-					var size int64
-					if protocol.IsDirectory(f.Flags) {
-						size = zeroEntrySize
-					} else {
-						size = f.Size()
-					}
-					tot += size
-					have += size
-				}
-				return true
-			})
-
-			m.repoFiles[repo].WithNeed(node, func(f protocol.FileInfo) bool {
-				if !protocol.IsDeleted(f.Flags) {
-					var size int64
-					if protocol.IsDirectory(f.Flags) {
-						size = zeroEntrySize
-					} else {
-						size = f.Size()
-					}
-					have -= size
-				}
-				return true
-			})
+			rf := m.repoFiles[repo]
+			global := rf.GlobalBytes()
+			tot += global
+			have += global - rf.NeedBytes(node)
 		}
 
 		ci.Completion = 100
@@ -213,69 +212,39 @@ func (m *Model) ConnectionStats() map[string]ConnectionInfo {
 	return res
 }
 
-func sizeOf(fs []protocol.FileInfo) (files, deleted int, bytes int64) {
-	for _, f := range fs {
-		fs, de, by := sizeOfFile(f)
-		files += fs
-		deleted += de
-		bytes += by
-	}
-	return
-}
-
-func sizeOfFile(f protocol.FileInfo) (files, deleted int, bytes int64) {
-	if !protocol.IsDeleted(f.Flags) {
-		files++
-		if !protocol.IsDirectory(f.Flags) {
-			bytes += f.Size()
-		} else {
-			bytes += zeroEntrySize
-		}
-	} else {
-		deleted++
-		bytes += zeroEntrySize
-	}
-	return
-}
-
 // GlobalSize returns the number of files, deleted files and total bytes for all
-// files in the global model.
+// files in the global model. The counts are maintained incrementally inside
+// files.Set as the index changes, so this is an O(1) lookup rather than a
+// scan of the full file list.
 func (m *Model) GlobalSize(repo string) (files, deleted int, bytes int64) {
 	m.rmut.RLock()
 	defer m.rmut.RUnlock()
 	if rf, ok := m.repoFiles[repo]; ok {
-		rf.WithGlobal(func(f protocol.FileInfo) bool {
-			fs, de, by := sizeOfFile(f)
-			files += fs
-			deleted += de
-			bytes += by
-			return true
-		})
+		files, deleted, bytes = rf.GlobalSize()
 	}
 	return
 }
 
 // LocalSize returns the number of files, deleted files and total bytes for all
-// files in the local repository.
+// files in the local repository. See GlobalSize for the O(1) note.
 func (m *Model) LocalSize(repo string) (files, deleted int, bytes int64) {
 	m.rmut.RLock()
 	defer m.rmut.RUnlock()
 	if rf, ok := m.repoFiles[repo]; ok {
-		rf.WithHave(protocol.LocalNodeID, func(f protocol.FileInfo) bool {
-			fs, de, by := sizeOfFile(f)
-			files += fs
-			deleted += de
-			bytes += by
-			return true
-		})
+		files, deleted, bytes = rf.LocalSize()
 	}
 	return
 }
 
 // NeedSize returns the number and total size of currently needed files.
 func (m *Model) NeedSize(repo string) (files int, bytes int64) {
-	f, d, b := sizeOf(m.NeedFilesRepo(repo))
-	return f + d, b
+	m.rmut.RLock()
+	defer m.rmut.RUnlock()
+	if rf, ok := m.repoFiles[repo]; ok {
+		f, d, b := rf.NeedSize(protocol.LocalNodeID)
+		files, bytes = f+d, b
+	}
+	return
 }
 
 // NeedFiles returns the list of currently needed files
@@ -315,6 +284,10 @@ func (m *Model) Index(nodeID protocol.NodeID, repo string, fs []protocol.FileInf
 		l.Fatalf("Index for nonexistant repo %q", repo)
 	}
 	m.rmut.RUnlock()
+
+	events.Default.Log(events.RemoteIndexUpdated, map[string]interface{}{
+		"node": nodeID.String(), "repo": repo, "items": len(fs),
+	})
 }
 
 // IndexUpdate is called for incremental updates to connected nodes' indexes.
@@ -336,6 +309,10 @@ func (m *Model) IndexUpdate(nodeID protocol.NodeID, repo string, fs []protocol.F
 		l.Fatalf("IndexUpdate for nonexistant repo %q", repo)
 	}
 	m.rmut.RUnlock()
+
+	events.Default.Log(events.RemoteIndexUpdated, map[string]interface{}{
+		"node": nodeID.String(), "repo": repo, "items": len(fs),
+	})
 }
 
 func (m *Model) repoSharedWith(repo string, nodeID protocol.NodeID) bool {
@@ -392,6 +369,14 @@ func (m *Model) Close(node protocol.NodeID, err error) {
 	delete(m.rawConn, node)
 	delete(m.nodeVer, node)
 	m.pmut.Unlock()
+
+	var errStr string
+	if err != nil {
+		errStr = err.Error()
+	}
+	events.Default.Log(events.NodeDisconnected, map[string]interface{}{
+		"id": node.String(), "error": errStr,
+	})
 }
 
 // Request returns the specified data segment by reading it from local disk.
@@ -446,8 +431,87 @@ func (m *Model) Request(nodeID protocol.NodeID, repo, name string, offset int64,
 // ReplaceLocal replaces the local repository index with the given list of files.
 func (m *Model) ReplaceLocal(repo string, fs []protocol.FileInfo) {
 	m.rmut.RLock()
-	m.repoFiles[repo].ReplaceWithDelete(protocol.LocalNodeID, fs)
+	rf := m.repoFiles[repo]
+
+	// Discard each file's previously indexed blocks before re-adding below,
+	// so that a rescan doesn't keep appending the same {repo,name,offset}
+	// locations to the block index every time it runs.
+	var old []protocol.FileInfo
+	rf.WithHave(protocol.LocalNodeID, func(f protocol.FileInfo) bool {
+		old = append(old, f)
+		return true
+	})
+
+	rf.ReplaceWithDelete(protocol.LocalNodeID, fs)
 	m.rmut.RUnlock()
+
+	for _, f := range old {
+		m.blockFinder.Discard(repo, f.Name, f.Blocks)
+	}
+
+	for _, f := range fs {
+		if protocol.IsDeleted(f.Flags) || protocol.IsInvalid(f.Flags) {
+			m.blockFinder.Discard(repo, f.Name, f.Blocks)
+		} else {
+			m.blockFinder.Add(repo, f.Name, f.Blocks)
+		}
+	}
+}
+
+// LocalBlock returns the data for a block with the given hash, read from
+// whatever local file the block index says currently holds it. This lets
+// the puller reuse blocks that are already present on disk -- for example
+// in a renamed file, a previous version, or an unrelated file that happens
+// to share content -- instead of fetching them from a remote node. The
+// returned data is verified against the hash before being handed back; if
+// no location yields a match, ErrNoSuchFile is returned.
+func (m *Model) LocalBlock(hash []byte) ([]byte, error) {
+	locs, err := m.blockFinder.Fetch(hash)
+	if err != nil {
+		return nil, err
+	}
+
+	m.rmut.RLock()
+	defer m.rmut.RUnlock()
+
+	for _, loc := range locs {
+		cfg, ok := m.repoCfgs[loc.repo]
+		if !ok {
+			continue
+		}
+
+		fn := filepath.Join(cfg.Directory, loc.name)
+		data, err := readVerifyBlock(fn, loc.offset, loc.size, hash)
+		if err != nil {
+			continue
+		}
+		return data, nil
+	}
+
+	return nil, ErrNoSuchFile
+}
+
+// readVerifyBlock reads size bytes at offset from the named file and
+// returns them if their SHA1 sum matches hash.
+func readVerifyBlock(name string, offset int64, size int32, hash []byte) ([]byte, error) {
+	fd, err := os.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer fd.Close()
+
+	data := make([]byte, size)
+	_, err = fd.ReadAt(data, offset)
+	if err != nil {
+		return nil, err
+	}
+
+	sum := sha1.Sum(data)
+	if !bytes.Equal(sum[:], hash) {
+		return nil, ErrInvalid
+	}
+
+	return data, nil
 }
 
 func (m *Model) CurrentRepoFile(repo string, file string) protocol.FileInfo {
@@ -482,6 +546,13 @@ func (m *Model) ConnectedTo(nodeID protocol.NodeID) bool {
 	return ok
 }
 
+// Subscribe returns a subscription receiving the events selected by mask.
+// This lets the GUI and other integrations react to model state changes as
+// they happen, instead of polling ConnectionStats/State/Version.
+func (m *Model) Subscribe(mask events.EventType) *events.Subscription {
+	return events.Default.Subscribe(mask)
+}
+
 // AddConnection adds a new peer connection to the model. An initial index will
 // be sent to the connected peer, thereafter index updates whenever the local
 // repository changes.
@@ -498,6 +569,10 @@ func (m *Model) AddConnection(rawConn io.Closer, protoConn protocol.Connection)
 	m.rawConn[nodeID] = rawConn
 	m.pmut.Unlock()
 
+	events.Default.Log(events.NodeConnected, map[string]interface{}{
+		"id": nodeID.String(),
+	})
+
 	cm := m.clusterConfig(nodeID)
 	protoConn.ClusterConfig(cm)
 
@@ -537,10 +612,30 @@ func (m *Model) protocolIndex(repo string) []protocol.FileInfo {
 	return fs
 }
 
+// updateLocal records that f is now the local content for repo, updating
+// the file and block indexes accordingly. It only ever runs after the new
+// content (or its absence, for a delete) is already on disk, so archiving
+// the previous content via the repo's Versioner has to happen before that
+// point -- see the puller, which is what actually overwrites or removes
+// repo files on behalf of the cluster.
 func (m *Model) updateLocal(repo string, f protocol.FileInfo) {
 	m.rmut.RLock()
+	old := m.repoFiles[repo].Get(protocol.LocalNodeID, f.Name)
 	m.repoFiles[repo].Update(protocol.LocalNodeID, []protocol.FileInfo{f})
 	m.rmut.RUnlock()
+
+	if old.Name == f.Name {
+		m.blockFinder.Discard(repo, old.Name, old.Blocks)
+	}
+	if protocol.IsDeleted(f.Flags) || protocol.IsInvalid(f.Flags) {
+		m.blockFinder.Discard(repo, f.Name, f.Blocks)
+	} else {
+		m.blockFinder.Add(repo, f.Name, f.Blocks)
+	}
+
+	events.Default.Log(events.LocalIndexUpdated, map[string]interface{}{
+		"repo": repo, "name": f.Name,
+	})
 }
 
 func (m *Model) requestGlobal(nodeID protocol.NodeID, repo, name string, offset int64, size int, hash []byte) ([]byte, error) {
@@ -614,6 +709,10 @@ func (m *Model) AddRepo(cfg config.RepositoryConfiguration) {
 	m.repoCfgs[cfg.ID] = cfg
 	m.repoFiles[cfg.ID] = files.NewSet(cfg.ID, m.db)
 	m.suppressor[cfg.ID] = &suppressor{threshold: int64(m.cfg.Options.MaxChangeKbps)}
+	m.repoIgnores[cfg.ID] = ignore.New(cfg.Directory)
+	if cfg.Versioning.Type != "" {
+		m.repoVersioners[cfg.ID] = versioner.New(cfg.Versioning.Type, cfg.Versioning.Params, cfg.Directory)
+	}
 
 	m.repoNodes[cfg.ID] = make([]protocol.NodeID, len(cfg.Nodes))
 	for i, node := range cfg.Nodes {
@@ -675,7 +774,7 @@ func (m *Model) ScanRepo(repo string) error {
 	m.rmut.RLock()
 	w := &scanner.Walker{
 		Dir:          m.repoCfgs[repo].Directory,
-		IgnoreFile:   ".stignore",
+		Matcher:      m.repoIgnores[repo],
 		BlockSize:    scanner.StandardBlockSize,
 		TempNamer:    defTempNamer,
 		Suppressor:   m.suppressor[repo],
@@ -693,6 +792,18 @@ func (m *Model) ScanRepo(repo string) error {
 	return nil
 }
 
+// Ignores returns the effective ignore patterns for the given repo's root,
+// for display in the GUI. Patterns loaded from nested directories during a
+// scan are not included, as they are scoped to their own subtree.
+func (m *Model) Ignores(repo string) []string {
+	m.rmut.RLock()
+	defer m.rmut.RUnlock()
+	if matcher, ok := m.repoIgnores[repo]; ok {
+		return matcher.Patterns()
+	}
+	return nil
+}
+
 func (m *Model) LoadIndexes(dir string) {
 	m.rmut.RLock()
 	for repo := range m.repoCfgs {
@@ -803,26 +914,22 @@ func (m *Model) clusterConfig(node protocol.NodeID) protocol.ClusterConfigMessag
 
 func (m *Model) setState(repo string, state repoState) {
 	m.smut.Lock()
+	oldState := m.repoState[repo]
 	m.repoState[repo] = state
 	m.smut.Unlock()
+
+	if state != oldState {
+		events.Default.Log(events.RepoStateChanged, map[string]interface{}{
+			"repo": repo, "from": oldState.String(), "to": state.String(),
+		})
+	}
 }
 
 func (m *Model) State(repo string) string {
 	m.smut.RLock()
 	state := m.repoState[repo]
 	m.smut.RUnlock()
-	switch state {
-	case RepoIdle:
-		return "idle"
-	case RepoScanning:
-		return "scanning"
-	case RepoCleaning:
-		return "cleaning"
-	case RepoSyncing:
-		return "syncing"
-	default:
-		return "unknown"
-	}
+	return state.String()
 }
 
 func (m *Model) Override(repo string) {
@@ -863,3 +970,84 @@ func (m *Model) Version(repo string) uint64 {
 
 	return ver
 }
+
+// versionerCleanLoop periodically applies the staggered retention policy to
+// every repo that has file versioning enabled, pruning versions that are
+// redundant under the policy.
+func (m *Model) versionerCleanLoop() {
+	for {
+		time.Sleep(time.Hour)
+
+		m.rmut.RLock()
+		vs := make([]versioner.Versioner, 0, len(m.repoVersioners))
+		for _, v := range m.repoVersioners {
+			vs = append(vs, v)
+		}
+		m.rmut.RUnlock()
+
+		for _, v := range vs {
+			sv, ok := v.(interface{ Clean() error })
+			if !ok {
+				continue
+			}
+			if err := sv.Clean(); err != nil {
+				l.Warnf("Cleaning versions: %v", err)
+			}
+		}
+	}
+}
+
+// Versioner returns the configured versioner for repo, if any. The puller's
+// delete/overwrite path uses this to archive a file's previous content into
+// the version store instead of unlinking it outright.
+func (m *Model) Versioner(repo string) (versioner.Versioner, bool) {
+	m.rmut.RLock()
+	defer m.rmut.RUnlock()
+	v, ok := m.repoVersioners[repo]
+	return v, ok
+}
+
+// Restore copies the named version of a file in repo back into the live
+// tree, overwriting the current content, and bumps its lamport version so
+// the change is propagated to the rest of the cluster.
+func (m *Model) Restore(repo, name, version string) error {
+	m.rmut.RLock()
+	v, ok := m.repoVersioners[repo]
+	cfg := m.repoCfgs[repo]
+	m.rmut.RUnlock()
+
+	if !ok {
+		return fmt.Errorf("repo %q has no versioning configured", repo)
+	}
+
+	if err := v.Restore(name, version); err != nil {
+		return err
+	}
+
+	// CurrentRepoFile(repo, name) still describes the pre-restore (or, if
+	// the file had been deleted, empty) content, so it can't be reused as
+	// is; rehash the file we just restored instead of trusting the old
+	// index entry.
+	blocks, err := scanner.HashFile(filepath.Join(cfg.Directory, name), scanner.StandardBlockSize)
+	if err != nil {
+		return err
+	}
+
+	old := m.CurrentRepoFile(repo, name)
+	f := protocol.FileInfo{
+		Name:    name,
+		Version: lamport.Default.Tick(old.Version),
+		Blocks:  blocks,
+	}
+	m.updateLocal(repo, f)
+
+	return nil
+}
+
+// ConfigSaved logs a ConfigSaved event. It should be called by whatever
+// persists the on-disk configuration; no such call site exists yet in this
+// tree, but the hook is provided so the GUI/config package can wire it in
+// once one does.
+func (m *Model) ConfigSaved(cfg config.Configuration) {
+	events.Default.Log(events.ConfigSaved, cfg)
+}
@@ -0,0 +1,211 @@
+// Copyright (C) 2014 Jakob Borg and Contributors (see the CONTRIBUTORS file).
+// All rights reserved. Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file.
+
+package model
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/calmh/syncthing/config"
+	"github.com/calmh/syncthing/events"
+	"github.com/calmh/syncthing/osutil"
+	"github.com/calmh/syncthing/protocol"
+)
+
+// puller pulls missing or outdated files for a single read/write repo from
+// the cluster, reusing whatever is already available locally before
+// fetching from a remote node.
+type puller struct {
+	repo    string
+	cfg     config.RepositoryConfiguration
+	model   *Model
+	threads int
+}
+
+// newPuller starts the pull loop for cfg.ID using up to threads concurrent
+// workers. threads == 0 means the repo is read-only, so nothing is started.
+func newPuller(cfg config.RepositoryConfiguration, m *Model, threads int, fullCfg *config.Configuration) *puller {
+	p := &puller{
+		repo:    cfg.ID,
+		cfg:     cfg,
+		model:   m,
+		threads: threads,
+	}
+
+	if threads > 0 {
+		go p.loop()
+	}
+
+	return p
+}
+
+// loop periodically checks for needed files and pulls them, up to
+// p.threads at a time.
+func (p *puller) loop() {
+	for {
+		time.Sleep(5 * time.Second)
+
+		if p.model.State(p.repo) != RepoIdle {
+			continue
+		}
+
+		need := p.model.NeedFilesRepo(p.repo)
+		if len(need) == 0 {
+			continue
+		}
+
+		p.model.setState(p.repo, RepoSyncing)
+
+		var wg sync.WaitGroup
+		sem := make(chan struct{}, p.threads)
+		for _, f := range need {
+			f := f
+			wg.Add(1)
+			sem <- struct{}{}
+			go func() {
+				defer wg.Done()
+				defer func() { <-sem }()
+				p.pullFile(f)
+			}()
+		}
+		wg.Wait()
+
+		p.model.setState(p.repo, RepoIdle)
+	}
+}
+
+// pullFile archives the file's current local content, if any, then brings
+// it up to date with f, either by writing new content or by removing it,
+// then updates the local index.
+func (p *puller) pullFile(f protocol.FileInfo) {
+	events.Default.Log(events.ItemStarted, map[string]interface{}{
+		"repo": p.repo, "item": f.Name,
+	})
+
+	if v, ok := p.model.Versioner(p.repo); ok {
+		if err := v.Archive(f.Name); err != nil {
+			l.Warnf("Archiving %q before pull: %v", f.Name, err)
+		}
+	}
+
+	err := p.pullFileContent(f)
+
+	var errStr string
+	if err != nil {
+		l.Warnf("Pulling %q: %v", f.Name, err)
+		errStr = err.Error()
+	} else {
+		p.model.updateLocal(p.repo, f)
+	}
+
+	events.Default.Log(events.ItemFinished, map[string]interface{}{
+		"repo": p.repo, "item": f.Name, "error": errStr,
+	})
+}
+
+// permMask is the part of FileInfo.Flags that carries the entry's Unix
+// permission bits, so that a pulled file or directory ends up with the
+// mode it was scanned with rather than some arbitrary default. Note:
+// this protocol era has no FlagSymlink, so symlinks aren't a pullable
+// entry type yet and pullFileContent only needs to special-case
+// directories alongside regular files.
+const permMask = 0xFFF
+
+// pullMode returns the Unix permission bits f was scanned with.
+func pullMode(f protocol.FileInfo) os.FileMode {
+	return os.FileMode(f.Flags & permMask)
+}
+
+// pullFileContent writes f's content to disk, or removes it if f is
+// deleted. Blocks are fetched via fetchBlock, which prefers a local copy
+// over requesting one from a remote node.
+func (p *puller) pullFileContent(f protocol.FileInfo) error {
+	fn := filepath.Join(p.cfg.Directory, f.Name)
+
+	if protocol.IsDeleted(f.Flags) {
+		err := os.Remove(fn)
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+
+	if protocol.IsDirectory(f.Flags) {
+		if err := os.MkdirAll(fn, 0777); err != nil && !os.IsExist(err) {
+			return err
+		}
+		if p.cfg.IgnorePerms {
+			return nil
+		}
+		return os.Chmod(fn, pullMode(f))
+	}
+
+	if err := os.MkdirAll(filepath.Dir(fn), 0755); err != nil && !os.IsExist(err) {
+		return err
+	}
+
+	mode := os.FileMode(0644)
+	if !p.cfg.IgnorePerms {
+		mode = pullMode(f)
+	}
+
+	tmp := fn + ".syncthing-tmp"
+	fd, err := os.OpenFile(tmp, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, mode)
+	if err != nil {
+		return err
+	}
+	defer fd.Close()
+
+	for _, b := range f.Blocks {
+		data, err := p.fetchBlock(f.Name, b)
+		if err != nil {
+			return fmt.Errorf("pull %q: block at offset %d: %v", f.Name, b.Offset, err)
+		}
+		if _, err := fd.WriteAt(data, b.Offset); err != nil {
+			return err
+		}
+	}
+
+	if err := fd.Close(); err != nil {
+		return err
+	}
+
+	if err := osutil.Rename(tmp, fn); err != nil {
+		return err
+	}
+
+	if p.cfg.IgnorePerms {
+		return nil
+	}
+	return os.Chmod(fn, mode)
+}
+
+// fetchBlock returns the data for block b of the file named name, trying
+// the local block index (populated from rescans, renames and other repos)
+// before requesting it from one of the repo's nodes.
+func (p *puller) fetchBlock(name string, b protocol.BlockInfo) ([]byte, error) {
+	if data, err := p.model.LocalBlock(b.Hash); err == nil {
+		return data, nil
+	}
+
+	p.model.rmut.RLock()
+	nodes := append([]protocol.NodeID(nil), p.model.repoNodes[p.repo]...)
+	p.model.rmut.RUnlock()
+
+	var lastErr error = ErrNoSuchFile
+	for _, nodeID := range nodes {
+		data, err := p.model.requestGlobal(nodeID, p.repo, name, b.Offset, int(b.Size), b.Hash)
+		if err != nil {
+			lastErr = err
+			continue
+		}
+		return data, nil
+	}
+
+	return nil, lastErr
+}
@@ -0,0 +1,198 @@
+// Copyright (C) 2014 Jakob Borg and Contributors (see the CONTRIBUTORS file).
+// All rights reserved. Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file.
+
+// Package versioner implements file versioning for repositories that have
+// it enabled. Instead of removing an old file on delete or overwrite, a
+// Versioner moves it aside into a ".stversions" directory, from where it
+// can later be listed and restored.
+package versioner
+
+import (
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/calmh/syncthing/osutil"
+)
+
+const versionsDir = ".stversions"
+
+// Versioner archives a repository file before it is overwritten or deleted,
+// and can later list and restore the versions it has kept.
+type Versioner interface {
+	// Archive moves the current content of relpath, if any, into the
+	// version store. It is a no-op if relpath does not currently exist.
+	Archive(relpath string) error
+
+	// Versions returns the timestamp tags of the stored versions of
+	// relpath, oldest first.
+	Versions(relpath string) ([]string, error)
+
+	// Restore copies the named version of relpath back into the live
+	// tree, overwriting whatever is there.
+	Restore(relpath, version string) error
+}
+
+// New creates a Versioner of the given type ("trashcan" or "staggered").
+// params is the type-specific configuration from RepositoryConfiguration.
+// root is the repository's root directory.
+func New(vtype string, params map[string]string, root string) Versioner {
+	switch vtype {
+	case "staggered":
+		return &staggered{trashcan{root: root}}
+	default:
+		return &trashcan{root: root}
+	}
+}
+
+// trashcan is the simplest versioner: every archived file keeps exactly one
+// timestamped copy per overwrite, kept forever.
+type trashcan struct {
+	root string
+}
+
+func (v *trashcan) Archive(relpath string) error {
+	src := filepath.Join(v.root, relpath)
+	if _, err := os.Lstat(src); os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+
+	dst := v.versionedName(relpath, time.Now())
+	if err := os.MkdirAll(filepath.Dir(dst), 0755); err != nil {
+		return err
+	}
+
+	return osutil.Rename(src, dst)
+}
+
+func (v *trashcan) versionedName(relpath string, at time.Time) string {
+	tag := strconv.FormatInt(at.Unix(), 10)
+	return filepath.Join(v.root, versionsDir, relpath+"~"+tag)
+}
+
+func (v *trashcan) Versions(relpath string) ([]string, error) {
+	dir := filepath.Join(v.root, versionsDir, filepath.Dir(relpath))
+	names, err := readDirNames(dir)
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	prefix := filepath.Base(relpath) + "~"
+	var tags []string
+	for _, name := range names {
+		if strings.HasPrefix(name, prefix) {
+			tags = append(tags, strings.TrimPrefix(name, prefix))
+		}
+	}
+	sort.Strings(tags)
+	return tags, nil
+}
+
+func (v *trashcan) Restore(relpath, version string) error {
+	src := filepath.Join(v.root, versionsDir, relpath+"~"+version)
+	if _, err := os.Lstat(src); err != nil {
+		return err
+	}
+
+	dst := filepath.Join(v.root, relpath)
+	if err := os.MkdirAll(filepath.Dir(dst), 0755); err != nil {
+		return err
+	}
+
+	return osutil.Copy(src, dst)
+}
+
+func readDirNames(dir string) ([]string, error) {
+	fd, err := os.Open(dir)
+	if err != nil {
+		return nil, err
+	}
+	defer fd.Close()
+	return fd.Readdirnames(-1)
+}
+
+// staggered behaves exactly like trashcan for archiving and restoring, but
+// its Clean method thins out old versions: one kept per hour for the last
+// day, one per day for the last week, and one per week beyond that.
+type staggered struct {
+	trashcan
+}
+
+type int64s []int64
+
+func (s int64s) Len() int           { return len(s) }
+func (s int64s) Less(i, j int) bool { return s[i] < s[j] }
+func (s int64s) Swap(i, j int)      { s[i], s[j] = s[j], s[i] }
+
+// retention is the list of age buckets, in ascending order of age, and the
+// minimum spacing to keep between versions within each bucket.
+var retention = []struct {
+	olderThan time.Duration
+	keepEvery time.Duration
+}{
+	{24 * time.Hour, time.Hour},
+	{7 * 24 * time.Hour, 24 * time.Hour},
+	{1<<63 - 1, 7 * 24 * time.Hour},
+}
+
+// Clean walks the version store and removes versions that are redundant
+// under the staggered retention policy described above. It should be
+// called periodically by a background goroutine.
+func (v *staggered) Clean() error {
+	groups := map[string][]int64{}
+
+	root := filepath.Join(v.root, versionsDir)
+	err := filepath.Walk(root, func(path string, info os.FileInfo, err error) error {
+		if err != nil || info == nil || info.IsDir() {
+			return nil
+		}
+		idx := strings.LastIndex(path, "~")
+		if idx < 0 {
+			return nil
+		}
+		tag, convErr := strconv.ParseInt(path[idx+1:], 10, 64)
+		if convErr != nil {
+			return nil
+		}
+		base := path[:idx]
+		groups[base] = append(groups[base], tag)
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	now := time.Now()
+	for base, tags := range groups {
+		sort.Sort(int64s(tags))
+
+		var lastKept time.Time
+		for _, tag := range tags {
+			at := time.Unix(tag, 0)
+			keepEvery := retention[len(retention)-1].keepEvery
+			age := now.Sub(at)
+			for _, bucket := range retention {
+				if age < bucket.olderThan {
+					keepEvery = bucket.keepEvery
+					break
+				}
+			}
+
+			if !lastKept.IsZero() && at.Sub(lastKept) < keepEvery {
+				os.Remove(base + "~" + strconv.FormatInt(tag, 10))
+				continue
+			}
+			lastKept = at
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,107 @@
+// Copyright (C) 2014 Jakob Borg and Contributors (see the CONTRIBUTORS file).
+// All rights reserved. Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file.
+
+package versioner
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestTrashcanArchiveAndRestore(t *testing.T) {
+	root, err := ioutil.TempDir("", "versioner-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+
+	fn := filepath.Join(root, "file.txt")
+	if err := ioutil.WriteFile(fn, []byte("v1"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	v := New("trashcan", nil, root)
+	if err := v.Archive("file.txt"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Lstat(fn); !os.IsNotExist(err) {
+		t.Fatal("expected original file to be moved aside by Archive")
+	}
+
+	versions, err := v.Versions("file.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(versions) != 1 {
+		t.Fatalf("got %d versions, want 1", len(versions))
+	}
+
+	if err := v.Restore("file.txt", versions[0]); err != nil {
+		t.Fatal(err)
+	}
+	data, err := ioutil.ReadFile(fn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(data) != "v1" {
+		t.Fatalf("restored content = %q, want v1", data)
+	}
+}
+
+func TestTrashcanArchiveNonexistentIsNoop(t *testing.T) {
+	root, err := ioutil.TempDir("", "versioner-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+
+	v := New("trashcan", nil, root)
+	if err := v.Archive("missing.txt"); err != nil {
+		t.Fatalf("Archive of a nonexistent file should be a no-op, got: %v", err)
+	}
+}
+
+func TestStaggeredCleanThinsWithinBucket(t *testing.T) {
+	root, err := ioutil.TempDir("", "versioner-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+
+	v := New("staggered", nil, root).(*staggered)
+
+	now := time.Now()
+	// Three versions within the last day, where one per hour is kept: the
+	// one ten minutes after the oldest is thinned out, the other two stay.
+	tags := []time.Time{
+		now.Add(-2 * time.Hour),
+		now.Add(-2*time.Hour + 10*time.Minute),
+		now.Add(-1 * time.Hour),
+	}
+	for _, at := range tags {
+		name := filepath.Join(root, versionsDir, "file.txt~"+strconv.FormatInt(at.Unix(), 10))
+		if err := os.MkdirAll(filepath.Dir(name), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(name, nil, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err := v.Clean(); err != nil {
+		t.Fatal(err)
+	}
+
+	remaining, err := v.Versions("file.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(remaining) != 2 {
+		t.Fatalf("got %d remaining versions, want 2 (the two versions less than an hour apart should thin to one)", len(remaining))
+	}
+}